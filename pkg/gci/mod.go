@@ -1,16 +1,48 @@
 package gci
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"golang.org/x/mod/modfile"
 )
 
+// modEntry holds everything moduleResolver knows about a single go.mod
+// (or go.work `use` entry) once it has been parsed.
+type modEntry struct {
+	// path is the module path declared by the `module` directive.
+	path string
+
+	// replace maps the old (import) path of every `replace` directive
+	// that points at a filesystem path to the local module path it
+	// should be attributed to, so that imports of the replaced module
+	// are grouped together with the replacing module's own imports.
+	replace map[string]string
+
+	// vendored maps the module path of every module listed in
+	// vendor/modules.txt to the directory of the main module that
+	// vendors it.
+	vendored map[string]string
+
+	// workspace holds the module path of every other member of the
+	// go.work workspace this module belongs to (i.e. every `use`
+	// directory except this one), so that imports of a workspace
+	// sibling can be classified as local rather than third-party.
+	workspace map[string]struct{}
+}
+
 // moduleResolver looksup the module path for a given (Go) file.
 // To improve performance, the file paths and module paths are
 // cached.
@@ -35,9 +67,110 @@ import (
 // When matching files against this cache, the resolver will select the
 // entry with the most specific path (so that, in this example, the file
 // cmd/sample/main.go will resolve to go.example.com/historic/path).
-type moduleResolver map[string]string
+//
+// If a go.work file is found while ascending the directory tree, every
+// module listed in its `use` directives is also added to the cache (see
+// findWorkspace), so that files belonging to any workspace sibling are
+// resolved to their own module path rather than being treated as an
+// unrelated, third-party import. Set SkipWorkspace to restore the old,
+// single-module behaviour.
+//
+// moduleResolver is safe for concurrent use: the cache is guarded by a
+// mutex, scanSema bounds how many directory scans (findRecursively) may
+// run at once, and inflight (see scanOnce) makes sure that concurrent
+// lookups for the same directory share a single scan instead of racing
+// each other, mirroring the pattern used by x/tools' own module
+// resolver.
+type moduleResolver struct {
+	mu    sync.RWMutex
+	cache map[string]*modEntry
+
+	// goListRuns remembers, per module root, which go.mod/go.work files
+	// (and their mtimes) contributed to the last `go list` run there,
+	// so a later change to any of them invalidates the cached module
+	// graph.
+	goListRuns map[string]watchedModFiles
+
+	// inflightMu guards inflight, which dedupes concurrent scans of the
+	// same directory: the first caller for a given directory does the
+	// actual work, and any caller that arrives while it's in flight
+	// just waits on its result instead of scanning the filesystem (or
+	// shelling out to `go list`) a second time.
+	inflightMu sync.Mutex
+	inflight   map[string]*inflightScan
+
+	scanSema chan struct{}
+}
+
+// inflightScan represents a findRecursively call that is currently
+// running on behalf of one or more waiting goroutines.
+type inflightScan struct {
+	done  chan struct{}
+	mpath string
+	err   error
+}
+
+// ScanConcurrency bounds how many goroutines may scan the filesystem for
+// go.mod/go.work files at the same time. It is read whenever a new
+// module cache is created (see ClearModCache). The default is
+// runtime.GOMAXPROCS(0).
+var ScanConcurrency = runtime.GOMAXPROCS(0)
+
+func newModuleResolver() *moduleResolver {
+	concurrency := ScanConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return &moduleResolver{
+		cache:      make(map[string]*modEntry),
+		goListRuns: make(map[string]watchedModFiles),
+		inflight:   make(map[string]*inflightScan),
+		scanSema:   make(chan struct{}, concurrency),
+	}
+}
+
+var modCache atomic.Pointer[moduleResolver]
+
+func init() {
+	modCache.Store(newModuleResolver())
+}
+
+// SkipWorkspace disables go.work discovery in findRecursively. When
+// true, moduleResolver only ever looks for the nearest go.mod, matching
+// gci's behaviour before go.work support was added.
+var SkipWorkspace bool
+
+// VendorSection holds the name of an import section for vendored
+// packages (i.e. packages that live under vendor/ because of `go mod
+// vendor`). Nothing in this package reads it: vendored modules are
+// only reported through moduleResolver.IsVendored, and setting
+// VendorSection does not change how imports are grouped.
+var VendorSection string
+
+// ModuleBackend selects how moduleResolver determines module metadata.
+type ModuleBackend string
+
+const (
+	// BackendAuto uses `go list -m -json all` when the go command is
+	// available, falling back to BackendGoMod otherwise. The zero value
+	// of ModuleBackend behaves the same way, and is the default.
+	BackendAuto ModuleBackend = "auto"
+
+	// BackendGoMod only ever parses go.mod/go.work directly and never
+	// shells out to the go command.
+	BackendGoMod ModuleBackend = "gomod"
 
-var modCache = make(moduleResolver)
+	// BackendGoList resolves modules via `go list -m -json all` and
+	// returns an error if the go command is unavailable or fails,
+	// rather than falling back to BackendGoMod. When no go.mod/go.work
+	// exists above a file, or `go list` reports no main module
+	// containing it, go.mod/go.work are parsed directly instead.
+	BackendGoList ModuleBackend = "golist"
+)
+
+// Backend selects the module-resolution backend used by moduleResolver.
+// The zero value behaves like BackendAuto.
+var Backend ModuleBackend
 
 // ClearModCache will reset the internal module cache used by ProcessFile
 // and WalkDir. When invoking either of those functions with an empty
@@ -45,65 +178,545 @@ var modCache = make(moduleResolver)
 //
 // You should call this method when you're done with processing files.
 func ClearModCache() {
-	modCache = make(moduleResolver)
+	modCache.Store(newModuleResolver())
+}
+
+func (m *moduleResolver) Lookup(file string) (string, error) {
+	if mpath, ok := m.lookupCache(file); ok {
+		return mpath, nil
+	}
+
+	dir, err := filepath.Abs(filepath.Dir(file))
+	if err != nil {
+		return "", fmt.Errorf("could not make path absolute: %w", err)
+	}
+
+	return m.scanOnce(dir)
+}
+
+// scanOnce resolves dir's module path via findRecursively, making sure
+// that concurrent calls for the same directory share a single scan
+// (and, with the go-list backend, a single `go list` invocation) rather
+// than racing each other.
+func (m *moduleResolver) scanOnce(dir string) (string, error) {
+	m.inflightMu.Lock()
+	if call, ok := m.inflight[dir]; ok {
+		m.inflightMu.Unlock()
+		<-call.done
+		return call.mpath, call.err
+	}
+
+	call := &inflightScan{done: make(chan struct{})}
+	m.inflight[dir] = call
+	m.inflightMu.Unlock()
+
+	m.scanSema <- struct{}{}
+	call.mpath, call.err = m.findRecursively(dir)
+	<-m.scanSema
+
+	m.inflightMu.Lock()
+	delete(m.inflight, dir)
+	m.inflightMu.Unlock()
+
+	close(call.done)
+	return call.mpath, call.err
 }
 
-func (m moduleResolver) Lookup(file string) (string, error) {
+func (m *moduleResolver) lookupCache(file string) (string, bool) {
+	entry, ok := m.entryForFile(file)
+	if !ok {
+		return "", false
+	}
+	return entry.path, true
+}
+
+// entryForFile returns the cache entry whose directory most specifically
+// contains file, i.e. the entry belonging to file's own module.
+func (m *moduleResolver) entryForFile(file string) (*modEntry, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
 	var bestMatch string
-	for path := range m {
+	for path := range m.cache {
 		if strings.HasPrefix(file, path) && len(path) > len(bestMatch) {
 			bestMatch = path
 		}
 	}
 
-	if bestMatch != "" {
-		return m[bestMatch], nil
+	if bestMatch == "" {
+		return nil, false
 	}
+	return m.cache[bestMatch], true
+}
 
-	dir, err := filepath.Abs(filepath.Dir(file))
-	if err != nil {
-		return "", fmt.Errorf("could not make path absolute: %w", err)
+// LookupReplaced reports whether importPath is the target of a local
+// (filesystem path) `replace` directive in file's own module, and if so,
+// returns the module path it should be grouped with. Callers should
+// consult this before falling back to treating importPath as a
+// third-party import. Note that file must already have been resolved
+// via Lookup, or this always reports false.
+func (m *moduleResolver) LookupReplaced(file, importPath string) (string, bool) {
+	entry, ok := m.entryForFile(file)
+	if !ok {
+		return "", false
+	}
+
+	for old := range entry.replace {
+		if importPath == old || strings.HasPrefix(importPath, old+"/") {
+			return entry.path, true
+		}
+	}
+
+	return "", false
+}
+
+// IsVendored reports whether importPath refers to a module listed in
+// file's own module's vendor/modules.txt. Note that file must already
+// have been resolved via Lookup, or this always reports false.
+func (m *moduleResolver) IsVendored(file, importPath string) bool {
+	entry, ok := m.entryForFile(file)
+	if !ok {
+		return false
+	}
+
+	for mod := range entry.vendored {
+		if importPath == mod || strings.HasPrefix(importPath, mod+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// LookupWorkspaceMember reports whether importPath belongs to another
+// member of file's own module's go.work workspace, and if so, returns
+// the module path it should be grouped with (file's own module, so that
+// workspace siblings are treated as local rather than third-party).
+// Note that file must already have been resolved via Lookup, or this
+// always reports false.
+func (m *moduleResolver) LookupWorkspaceMember(file, importPath string) (string, bool) {
+	entry, ok := m.entryForFile(file)
+	if !ok {
+		return "", false
 	}
 
-	return m.findRecursively(dir)
+	for mod := range entry.workspace {
+		if importPath == mod || strings.HasPrefix(importPath, mod+"/") {
+			return entry.path, true
+		}
+	}
+
+	return "", false
+}
+
+func (m *moduleResolver) store(dir string, entry *modEntry) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cache[dir] = entry
 }
 
-func (m moduleResolver) findRecursively(dir string) (string, error) {
+func (m *moduleResolver) findRecursively(dir string) (string, error) {
+	if Backend != BackendGoMod {
+		mpath, ok, err := m.findWithGoCommand(dir)
+		if err != nil {
+			if Backend == BackendGoList {
+				return "", err
+			}
+			// BackendAuto: fall back to parsing go.mod/go.work
+			// ourselves, e.g. because the go command isn't installed
+		} else if ok {
+			return mpath, nil
+		}
+	}
+
 	// When going up the directory tree, we might never find a go.mod
 	// file. In this case remember where we started, so that the next
 	// time we can short circuit the recursive ascent.
 	stop := dir
 
 	for {
+		if !SkipWorkspace {
+			gowork := filepath.Join(dir, "go.work")
+			if _, err := os.Stat(gowork); err == nil {
+				if mpath, ok, err := m.findWorkspace(dir, gowork, stop); err != nil {
+					return "", err
+				} else if ok {
+					return mpath, nil
+				}
+				// none of the workspace's `use` directories is an
+				// ancestor of stop; keep ascending past go.work in
+				// case an enclosing go.mod still applies
+			} else if !errors.Is(err, os.ErrNotExist) {
+				return "", fmt.Errorf("workspace lookup failed: %w", err)
+			}
+		}
+
 		gomod := filepath.Join(dir, "go.mod")
-		_, err := os.Stat(gomod)
-		if errors.Is(err, os.ErrNotExist) {
+		if _, err := os.Stat(gomod); errors.Is(err, os.ErrNotExist) {
 			// go.mod doesn't exists at current location
 			next := filepath.Dir(dir)
 			if next == dir {
 				// we're at the top of the filesystem
-				m[stop] = ""
+				m.store(stop, &modEntry{})
 				return "", nil
 			}
 			// go one level up
 			dir = next
 			continue
 		} else if err != nil {
-			// other error (likely EPERM
 			return "", fmt.Errorf("module lookup failed: %w", err)
 		}
 
 		// we found a go.mod
-		mod, err := ioutil.ReadFile(gomod)
+		entry, err := loadModEntry(dir)
 		if err != nil {
 			return "", fmt.Errorf("reading module failed: %w", err)
 		}
 
-		// store module path at m[dir]. add path separator to avoid
+		// store the entry at dir. add path separator to avoid
 		// false-positive (think of /foo and /foobar).
-		mpath := modfile.ModulePath(mod)
-		m[dir+string(os.PathSeparator)] = mpath
+		m.store(dir+string(os.PathSeparator), entry)
 
-		return mpath, nil
+		// a go.work further up still applies to this module
+		if !SkipWorkspace {
+			if root, ok := nearestGoModRoot(dir); ok && root != dir {
+				if mpath, ok, err := m.findWorkspace(root, filepath.Join(root, "go.work"), stop); err != nil {
+					return "", err
+				} else if ok {
+					return mpath, nil
+				}
+			}
+		}
+
+		return entry.path, nil
+	}
+}
+
+// isLocalReplace reports whether r replaces a module with a filesystem
+// path rather than another module@version. Per the go.mod grammar, a
+// filesystem replacement target never carries a version.
+func isLocalReplace(r *modfile.Replace) bool {
+	return r.New.Version == ""
+}
+
+// loadModEntry reads and parses the go.mod file in dir, along with its
+// vendor/modules.txt (if present), into a modEntry.
+func loadModEntry(dir string) (*modEntry, error) {
+	gomod := filepath.Join(dir, "go.mod")
+	raw, err := ioutil.ReadFile(gomod)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := modfile.Parse(gomod, raw, nil)
+	if err != nil {
+		return nil, fmt.Errorf("parsing module failed: %w", err)
+	}
+
+	replace := make(map[string]string, len(file.Replace))
+	for _, r := range file.Replace {
+		if !isLocalReplace(r) {
+			// a module@version replace, not a filesystem path
+			continue
+		}
+		replace[r.Old.Path] = file.Module.Mod.Path
+	}
+
+	vendored, err := parseVendorModules(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	return &modEntry{path: file.Module.Mod.Path, replace: replace, vendored: vendored}, nil
+}
+
+// parseVendorModules reads dir/vendor/modules.txt (if it exists) and
+// returns the module path of every vendored dependency, mapped to dir
+// (the main module that vendors it).
+func parseVendorModules(dir string) (map[string]string, error) {
+	raw, err := ioutil.ReadFile(filepath.Join(dir, "vendor", "modules.txt"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("reading vendor modules failed: %w", err)
 	}
+
+	vendored := make(map[string]string)
+	for _, line := range strings.Split(string(raw), "\n") {
+		// we're only interested in "# module/path v1.2.3" lines, not
+		// "## explicit" or "# module/path => replacement" ones
+		if !strings.HasPrefix(line, "# ") || strings.Contains(line, "=>") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			continue
+		}
+		vendored[fields[1]] = dir
+	}
+
+	return vendored, nil
+}
+
+// listedModule mirrors the fields of `go list -m -json` that we care
+// about; see `go help mod list -json` for the full schema.
+type listedModule struct {
+	Path    string
+	Dir     string
+	Main    bool
+	Replace *listedModule
+}
+
+// findWithGoCommand resolves the module path for dir using `go list -m
+// -json all`, which (unlike parsing a single go.mod) also accounts for
+// go.work files and the full replace/exclude graph. ok is false if no
+// go.mod/go.work could be found above dir, in which case the caller
+// should fall back to its own ascent.
+func (m *moduleResolver) findWithGoCommand(dir string) (mpath string, ok bool, err error) {
+	root, found := nearestGoModRoot(dir)
+	if !found {
+		return "", false, nil
+	}
+	cacheKey := goListCacheKey(root)
+
+	m.mu.RLock()
+	watched, seen := m.goListRuns[cacheKey]
+	m.mu.RUnlock()
+
+	if seen && !watched.changed() {
+		if mpath, ok := m.lookupCache(dir); ok {
+			return mpath, true, nil
+		}
+	}
+
+	mods, err := runGoList(root)
+	if err != nil {
+		return "", false, err
+	}
+	// in workspace mode, every `use` module is listed with Main set
+	mains := make(map[string]struct{})
+	for _, mod := range mods {
+		if mod.Main {
+			mains[mod.Path] = struct{}{}
+		}
+	}
+
+	needle := dir + string(os.PathSeparator)
+	var bestMatch string
+	watched = watchedModFiles{filepath.Join(root, "go.work"): statModTime(filepath.Join(root, "go.work"))}
+	for _, mod := range mods {
+		modDir := mod.Dir
+		if mod.Replace != nil && mod.Replace.Dir != "" {
+			modDir = mod.Replace.Dir
+		}
+		if modDir == "" {
+			// modules without a Dir can't be resolved to a local path
+			continue
+		}
+
+		gomod := filepath.Join(modDir, "go.mod")
+		watched[gomod] = statModTime(gomod)
+
+		entry, err := loadModEntry(modDir)
+		if err != nil {
+			entry = &modEntry{path: mod.Path}
+		}
+		if mod.Main {
+			entry.workspace = make(map[string]struct{}, len(mains))
+			for p := range mains {
+				if p != mod.Path {
+					entry.workspace[p] = struct{}{}
+				}
+			}
+		}
+
+		key := modDir + string(os.PathSeparator)
+		m.store(key, entry)
+
+		if mod.Main && strings.HasPrefix(needle, key) && len(key) > len(bestMatch) {
+			bestMatch, mpath = key, mod.Path
+		}
+	}
+
+	m.mu.Lock()
+	m.goListRuns[cacheKey] = watched
+	m.mu.Unlock()
+
+	return mpath, mpath != "", nil
+}
+
+// watchedModFiles remembers the mtime we observed for every go.mod/
+// go.work file that contributed to a `go list` run, so we can tell
+// whether any of them has since changed.
+type watchedModFiles map[string]time.Time
+
+func (w watchedModFiles) changed() bool {
+	for path, mtime := range w {
+		if statModTime(path) != mtime {
+			return true
+		}
+	}
+	return false
+}
+
+func statModTime(path string) time.Time {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return fi.ModTime()
+}
+
+// nearestGoModRoot ascends from dir looking for the root `go list`
+// should run from. An enclosing go.work always wins over a go.mod found
+// along the way, since `go list` needs to run from the workspace root
+// to see every member, so ascent continues past any go.mod in search of
+// an outer go.work; only once the filesystem root is reached without
+// finding one does the nearest go.mod (if any) get returned. When
+// SkipWorkspace is set, go.work is ignored entirely and only the
+// nearest go.mod counts, matching the ascent findRecursively itself
+// would perform.
+func nearestGoModRoot(dir string) (root string, ok bool) {
+	gomodRoot, haveGomod := "", false
+
+	for {
+		if !SkipWorkspace {
+			if _, err := os.Stat(filepath.Join(dir, "go.work")); err == nil {
+				return dir, true
+			}
+		}
+
+		if !haveGomod {
+			if _, err := os.Stat(filepath.Join(dir, "go.mod")); err == nil {
+				gomodRoot, haveGomod = dir, true
+			}
+		}
+
+		next := filepath.Dir(dir)
+		if next == dir {
+			return gomodRoot, haveGomod
+		}
+		dir = next
+	}
+}
+
+// goListCacheKey namespaces a goListRuns cache entry by SkipWorkspace,
+// so that toggling it doesn't serve a `go list` result gathered under
+// the other mode.
+func goListCacheKey(root string) string {
+	if SkipWorkspace {
+		return "skipworkspace\x00" + root
+	}
+	return root
+}
+
+// runGoList shells out to `go list -m -json all` in dir and decodes the
+// resulting stream of JSON objects. When SkipWorkspace is set, GOWORK is
+// disabled for the subprocess so that an enclosing go.work (if any)
+// can't pull in workspace siblings as local modules.
+func runGoList(dir string) ([]listedModule, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), goListTimeout)
+	defer cancel()
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "go", "list", "-m", "-json", "all")
+	cmd.Dir = dir
+	cmd.Stderr = &stderr
+	if SkipWorkspace {
+		cmd.Env = append(os.Environ(), "GOWORK=off")
+	}
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("go list failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	var mods []listedModule
+	dec := json.NewDecoder(bytes.NewReader(out))
+	for dec.More() {
+		var mod listedModule
+		if err := dec.Decode(&mod); err != nil {
+			return nil, fmt.Errorf("decoding go list output failed: %w", err)
+		}
+		mods = append(mods, mod)
+	}
+
+	return mods, nil
+}
+
+// goListTimeout bounds how long a single `go list` invocation may run,
+// so that a stalled process (e.g. blocked on a network fetch) can't tie
+// up a scanSema slot indefinitely.
+const goListTimeout = 30 * time.Second
+
+// findWorkspace parses the go.work file found at gowork (while ascending
+// from stop towards dir) and registers every one of its `use` directives
+// in the cache, keyed by the directory's absolute path. It returns the
+// module path belonging to stop (i.e. the directory the original lookup
+// started from), and ok=false if none of the workspace's `use`
+// directories is an ancestor of stop, so the caller can keep ascending
+// past go.work in search of an enclosing go.mod.
+func (m *moduleResolver) findWorkspace(dir, gowork, stop string) (mpath string, ok bool, err error) {
+	data, err := ioutil.ReadFile(gowork)
+	if err != nil {
+		return "", false, fmt.Errorf("reading workspace failed: %w", err)
+	}
+
+	wf, err := modfile.ParseWork(gowork, data, nil)
+	if err != nil {
+		return "", false, fmt.Errorf("parsing workspace failed: %w", err)
+	}
+
+	type member struct {
+		dir   string
+		entry *modEntry
+	}
+
+	var members []member
+	for _, use := range wf.Use {
+		useDir := use.Path
+		if !filepath.IsAbs(useDir) {
+			useDir = filepath.Join(dir, useDir)
+		}
+
+		entry, err := loadModEntry(useDir)
+		if err != nil {
+			// a `use` directive without a readable/valid go.mod can't
+			// contribute a module path; skip it rather than failing
+			// the whole workspace lookup
+			continue
+		}
+
+		members = append(members, member{dir: useDir, entry: entry})
+	}
+
+	// every workspace member needs to know every other member's module
+	// path, so that an import of a sibling can be grouped with the
+	// importing module's own imports instead of being treated as a
+	// third-party dependency
+	siblings := make(map[string]struct{}, len(members))
+	for _, mem := range members {
+		siblings[mem.entry.path] = struct{}{}
+	}
+
+	var bestMatch string
+	for _, mem := range members {
+		workspace := make(map[string]struct{}, len(siblings))
+		for sibling := range siblings {
+			if sibling != mem.entry.path {
+				workspace[sibling] = struct{}{}
+			}
+		}
+		mem.entry.workspace = workspace
+
+		key := mem.dir + string(os.PathSeparator)
+		m.store(key, mem.entry)
+
+		if strings.HasPrefix(stop+string(os.PathSeparator), key) && len(key) > len(bestMatch) {
+			bestMatch, mpath = key, mem.entry.path
+		}
+	}
+
+	return mpath, bestMatch != "", nil
 }
@@ -0,0 +1,330 @@
+package gci
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// writeTestFile writes content to path, creating any missing parent
+// directories along the way.
+func writeTestFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatalf("mkdir %s: %v", filepath.Dir(path), err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("write %s: %v", path, err)
+	}
+}
+
+// tempDir returns a fresh, symlink-resolved temporary directory, so that
+// prefix comparisons against moduleResolver's cache keys behave the same
+// way they would on a real checkout.
+func tempDir(t *testing.T) string {
+	t.Helper()
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatalf("eval symlinks: %v", err)
+	}
+	return dir
+}
+
+func TestModuleResolver_Workspace(t *testing.T) {
+	root := tempDir(t)
+
+	writeTestFile(t, filepath.Join(root, "go.work"), "go 1.21\n\nuse (\n\t./a\n\t./b\n)\n")
+	writeTestFile(t, filepath.Join(root, "a", "go.mod"), "module example.com/a\n\ngo 1.21\n")
+	writeTestFile(t, filepath.Join(root, "a", "cmd", "main.go"), "package main\n")
+	writeTestFile(t, filepath.Join(root, "b", "go.mod"), "module example.com/b\n\ngo 1.21\n\nreplace example.com/outside => ../outside\n")
+	writeTestFile(t, filepath.Join(root, "b", "pkg", "pkg.go"), "package pkg\n")
+	writeTestFile(t, filepath.Join(root, "outside", "go.mod"), "module example.com/outside\n\ngo 1.21\n")
+
+	m := newModuleResolver()
+
+	aFile := filepath.Join(root, "a", "cmd", "main.go")
+	bFile := filepath.Join(root, "b", "pkg", "pkg.go")
+
+	if got, err := m.Lookup(aFile); err != nil || got != "example.com/a" {
+		t.Fatalf("Lookup(a/cmd/main.go) = %q, %v; want example.com/a, nil", got, err)
+	}
+	if got, err := m.Lookup(bFile); err != nil || got != "example.com/b" {
+		t.Fatalf("Lookup(b/pkg/pkg.go) = %q, %v; want example.com/b, nil", got, err)
+	}
+
+	// a and b are workspace siblings: an import of one from the other
+	// must be classified as local, grouped with the importing module.
+	if got, ok := m.LookupWorkspaceMember(aFile, "example.com/b"); !ok || got != "example.com/a" {
+		t.Fatalf("LookupWorkspaceMember(a, b) = %q, %v; want example.com/a, true", got, ok)
+	}
+	if got, ok := m.LookupWorkspaceMember(aFile, "example.com/b/pkg"); !ok || got != "example.com/a" {
+		t.Fatalf("LookupWorkspaceMember(a, b/pkg) = %q, %v; want example.com/a, true", got, ok)
+	}
+	if got, ok := m.LookupWorkspaceMember(bFile, "example.com/a"); !ok || got != "example.com/b" {
+		t.Fatalf("LookupWorkspaceMember(b, a) = %q, %v; want example.com/b, true", got, ok)
+	}
+
+	// example.com/outside is only reachable via b's replace directive,
+	// not a workspace `use` entry, so it must not be misclassified as a
+	// workspace member.
+	if got, ok := m.LookupWorkspaceMember(aFile, "example.com/outside"); ok {
+		t.Fatalf("LookupWorkspaceMember(a, outside) = %q, %v; want _, false", got, ok)
+	}
+}
+
+func TestModuleResolver_Workspace_AncestorFallback(t *testing.T) {
+	parent := tempDir(t)
+	writeTestFile(t, filepath.Join(parent, "go.mod"), "module example.com/parent\n\ngo 1.21\n")
+
+	root := filepath.Join(parent, "workspace")
+	writeTestFile(t, filepath.Join(root, "go.work"), "go 1.21\n\nuse ./a\n")
+	writeTestFile(t, filepath.Join(root, "a", "go.mod"), "module example.com/a\n\ngo 1.21\n")
+	// a file directly in the workspace directory, outside any `use`'d module
+	writeTestFile(t, filepath.Join(root, "stray.go"), "package workspace\n")
+
+	m := newModuleResolver()
+
+	got, err := m.Lookup(filepath.Join(root, "stray.go"))
+	if err != nil {
+		t.Fatalf("Lookup(stray.go): %v", err)
+	}
+	if got != "example.com/parent" {
+		t.Fatalf("Lookup(stray.go) = %q; want example.com/parent (ancestor go.mod)", got)
+	}
+}
+
+func TestModuleResolver_LookupReplaced(t *testing.T) {
+	root := tempDir(t)
+
+	// a replaces example.com/outside with a nested, relative path whose
+	// target has its own go.mod.
+	writeTestFile(t, filepath.Join(root, "a", "go.mod"), "module example.com/a\n\ngo 1.21\n\nreplace example.com/outside => ../vendor/outside\n")
+	writeTestFile(t, filepath.Join(root, "a", "main.go"), "package main\n")
+	writeTestFile(t, filepath.Join(root, "vendor", "outside", "go.mod"), "module example.com/outside\n\ngo 1.21\n")
+
+	// b is an unrelated module that does not replace anything.
+	writeTestFile(t, filepath.Join(root, "b", "go.mod"), "module example.com/b\n\ngo 1.21\n")
+	writeTestFile(t, filepath.Join(root, "b", "main.go"), "package main\n")
+
+	m := newModuleResolver()
+
+	aFile := filepath.Join(root, "a", "main.go")
+	bFile := filepath.Join(root, "b", "main.go")
+
+	if _, err := m.Lookup(aFile); err != nil {
+		t.Fatalf("Lookup(a): %v", err)
+	}
+	if _, err := m.Lookup(bFile); err != nil {
+		t.Fatalf("Lookup(b): %v", err)
+	}
+
+	if got, ok := m.LookupReplaced(aFile, "example.com/outside"); !ok || got != "example.com/a" {
+		t.Fatalf("LookupReplaced(a, outside) = %q, %v; want example.com/a, true", got, ok)
+	}
+	if got, ok := m.LookupReplaced(aFile, "example.com/outside/sub/pkg"); !ok || got != "example.com/a" {
+		t.Fatalf("LookupReplaced(a, outside/sub/pkg) = %q, %v; want example.com/a, true", got, ok)
+	}
+
+	// b does not replace example.com/outside; its classification must
+	// not be polluted by an unrelated module's replace directive.
+	if got, ok := m.LookupReplaced(bFile, "example.com/outside"); ok {
+		t.Fatalf("LookupReplaced(b, outside) = %q, %v; want _, false", got, ok)
+	}
+}
+
+// TestModuleResolver_ConcurrentLookup fires many concurrent Lookup calls
+// at hundreds of files across several never-before-cached modules. Run
+// with -race to exercise the inflight/scanOnce dedup added to guard
+// against concurrent scans of the same directory racing each other.
+func TestModuleResolver_ConcurrentLookup(t *testing.T) {
+	const numModules = 4
+	const filesPerModule = 50
+
+	root := tempDir(t)
+	for i := 0; i < numModules; i++ {
+		modDir := filepath.Join(root, fmt.Sprintf("mod%d", i))
+		writeTestFile(t, filepath.Join(modDir, "go.mod"), fmt.Sprintf("module example.com/mod%d\n\ngo 1.21\n", i))
+		for j := 0; j < filesPerModule; j++ {
+			writeTestFile(t, filepath.Join(modDir, fmt.Sprintf("file%d.go", j)), "package mod\n")
+		}
+	}
+
+	m := newModuleResolver()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, numModules*filesPerModule)
+	for i := 0; i < numModules; i++ {
+		for j := 0; j < filesPerModule; j++ {
+			i, j := i, j
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				file := filepath.Join(root, fmt.Sprintf("mod%d", i), fmt.Sprintf("file%d.go", j))
+				got, err := m.Lookup(file)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if want := fmt.Sprintf("example.com/mod%d", i); got != want {
+					errs <- fmt.Errorf("Lookup(%s) = %q; want %q", file, got, want)
+				}
+			}()
+		}
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestModuleResolver_Vendored(t *testing.T) {
+	root := tempDir(t)
+
+	// a vendored checkout of example.com/app
+	vRoot := filepath.Join(root, "vendored")
+	writeTestFile(t, filepath.Join(vRoot, "go.mod"), "module example.com/app\n\ngo 1.21\n")
+	writeTestFile(t, filepath.Join(vRoot, "main.go"), "package main\n")
+	writeTestFile(t, filepath.Join(vRoot, "vendor", "modules.txt"), "# example.com/dep v1.0.0\n## explicit\nexample.com/dep\n")
+	writeTestFile(t, filepath.Join(vRoot, "vendor", "example.com", "dep", "dep.go"), "package dep\n")
+
+	// a non-vendored checkout of the same module
+	nRoot := filepath.Join(root, "nonvendored")
+	writeTestFile(t, filepath.Join(nRoot, "go.mod"), "module example.com/app\n\ngo 1.21\n")
+	writeTestFile(t, filepath.Join(nRoot, "main.go"), "package main\n")
+
+	m := newModuleResolver()
+
+	vFile := filepath.Join(vRoot, "main.go")
+	nFile := filepath.Join(nRoot, "main.go")
+
+	if _, err := m.Lookup(vFile); err != nil {
+		t.Fatalf("Lookup(vendored): %v", err)
+	}
+	if _, err := m.Lookup(nFile); err != nil {
+		t.Fatalf("Lookup(nonvendored): %v", err)
+	}
+
+	if !m.IsVendored(vFile, "example.com/dep") {
+		t.Fatalf("IsVendored(vendored, example.com/dep) = false; want true")
+	}
+	if !m.IsVendored(vFile, "example.com/dep/sub/pkg") {
+		t.Fatalf("IsVendored(vendored, example.com/dep/sub/pkg) = false; want true")
+	}
+	if m.IsVendored(nFile, "example.com/dep") {
+		t.Fatalf("IsVendored(nonvendored, example.com/dep) = true; want false")
+	}
+}
+
+// TestNearestGoModRoot_SkipWorkspace pins down the SkipWorkspace behavior
+// that the go-list backend relies on: with SkipWorkspace set, a go.work
+// file must not count as a module root, so ascent continues past it to
+// an enclosing go.mod instead of stopping at the workspace.
+func TestNearestGoModRoot_SkipWorkspace(t *testing.T) {
+	parent := tempDir(t)
+	writeTestFile(t, filepath.Join(parent, "go.mod"), "module example.com/parent\n\ngo 1.21\n")
+
+	root := filepath.Join(parent, "workspace")
+	writeTestFile(t, filepath.Join(root, "go.work"), "go 1.21\n\nuse ./a\n")
+
+	origSkip := SkipWorkspace
+	t.Cleanup(func() { SkipWorkspace = origSkip })
+
+	SkipWorkspace = false
+	if got, ok := nearestGoModRoot(root); !ok || got != root {
+		t.Fatalf("nearestGoModRoot(root) = %q, %v; want %q, true (go.work should count)", got, ok, root)
+	}
+
+	SkipWorkspace = true
+	if got, ok := nearestGoModRoot(root); !ok || got != parent {
+		t.Fatalf("nearestGoModRoot(root) with SkipWorkspace = %q, %v; want %q, true (go.work must be ignored)", got, ok, parent)
+	}
+}
+
+// TestNearestGoModRoot_PrefersOuterWorkspace pins down that an outer
+// go.work takes precedence over a go.mod found while ascending past it,
+// for the common layout where each workspace member has its own go.mod
+// one level below go.work.
+func TestNearestGoModRoot_PrefersOuterWorkspace(t *testing.T) {
+	root := tempDir(t)
+	writeTestFile(t, filepath.Join(root, "go.work"), "go 1.21\n\nuse ./a\n")
+	writeTestFile(t, filepath.Join(root, "a", "go.mod"), "module example.com/a\n\ngo 1.21\n")
+
+	if got, ok := nearestGoModRoot(filepath.Join(root, "a")); !ok || got != root {
+		t.Fatalf("nearestGoModRoot(a) = %q, %v; want %q, true (outer go.work should win)", got, ok, root)
+	}
+}
+
+// TestModuleResolver_GoListBackend exercises BackendGoList end to end. It
+// is skipped when the go command isn't on PATH, matching the sandboxed
+// environments this package is sometimes built in.
+func TestModuleResolver_GoListBackend(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go command not available")
+	}
+
+	root := tempDir(t)
+	writeTestFile(t, filepath.Join(root, "go.mod"), "module example.com/app\n\ngo 1.21\n")
+	writeTestFile(t, filepath.Join(root, "main.go"), "package main\n")
+
+	origBackend := Backend
+	Backend = BackendGoList
+	t.Cleanup(func() { Backend = origBackend })
+
+	m := newModuleResolver()
+	got, err := m.Lookup(filepath.Join(root, "main.go"))
+	if err != nil {
+		t.Fatalf("Lookup: %v", err)
+	}
+	if got != "example.com/app" {
+		t.Fatalf("Lookup = %q; want example.com/app", got)
+	}
+}
+
+// TestModuleResolver_GoListBackend_WatchesWorkspaceRoot guards against
+// the go-list cache watching the wrong file: for a workspace member, the
+// real go.work lives above the member's own go.mod, and an edit to it
+// must invalidate the cached module graph on the next lookup rather
+// than being silently ignored forever.
+func TestModuleResolver_GoListBackend_WatchesWorkspaceRoot(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go command not available")
+	}
+
+	root := tempDir(t)
+	writeTestFile(t, filepath.Join(root, "go.work"), "go 1.21\n\nuse ./a\n")
+	writeTestFile(t, filepath.Join(root, "a", "go.mod"), "module example.com/a\n\ngo 1.21\n")
+	writeTestFile(t, filepath.Join(root, "a", "main.go"), "package main\n")
+
+	origBackend := Backend
+	Backend = BackendGoList
+	t.Cleanup(func() { Backend = origBackend })
+
+	m := newModuleResolver()
+	aFile := filepath.Join(root, "a", "main.go")
+
+	if got, err := m.Lookup(aFile); err != nil || got != "example.com/a" {
+		t.Fatalf("Lookup(a) = %q, %v; want example.com/a, nil", got, err)
+	}
+	if _, ok := m.LookupWorkspaceMember(aFile, "example.com/b"); ok {
+		t.Fatalf("LookupWorkspaceMember(a, b) = true before b joined the workspace")
+	}
+
+	// add a second workspace member and update go.work to include it;
+	// the next lookup must pick up the change.
+	writeTestFile(t, filepath.Join(root, "b", "go.mod"), "module example.com/b\n\ngo 1.21\n")
+	time.Sleep(10 * time.Millisecond) // ensure a distinct mtime
+	writeTestFile(t, filepath.Join(root, "go.work"), "go 1.21\n\nuse (\n\t./a\n\t./b\n)\n")
+
+	if _, err := m.Lookup(aFile); err != nil {
+		t.Fatalf("Lookup(a) after go.work edit: %v", err)
+	}
+	if _, ok := m.LookupWorkspaceMember(aFile, "example.com/b"); !ok {
+		t.Fatalf("LookupWorkspaceMember(a, b) = false after go.work was edited to add b; cache wasn't invalidated")
+	}
+}